@@ -0,0 +1,644 @@
+// Package disk provides a drivers.Driver implementation backed by OPA's
+// Badger-based storage/disk store, for deployments where the policy and
+// data set is too large to comfortably hold in memory.
+//
+// disk doesn't yet have local's prepared-query cache, tracing, or
+// PartialTranslator support; those were added to local first and haven't
+// been ported over.
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luckoseabraham/opa-driver/pkg/drivers"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/logging"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/disk"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type module struct {
+	text   string
+	parsed *ast.Module
+}
+
+type insertParam map[string]*module
+
+func (i insertParam) add(name string, src string) error {
+	m, err := ast.ParseModule(name, src)
+	if err != nil {
+		return err
+	}
+	i[name] = &module{text: src, parsed: m}
+	return nil
+}
+
+// MetricsHook is called after every storage operation issued by the driver,
+// with the operation name and how long it took. Callers can wire this up to
+// a Prometheus histogram/summary without the driver depending on any
+// particular metrics library.
+type MetricsHook func(op string, took time.Duration)
+
+// Arg configures the disk driver at construction time.
+type Arg func(*driver)
+
+// Dir sets the directory the Badger store persists policy and data under.
+func Dir(path string) Arg {
+	return func(d *driver) {
+		d.opts.Dir = path
+	}
+}
+
+// AutoCreate controls whether the store directory is created if it does
+// not already exist. storage/disk.Options has no such notion itself, so
+// New does the os.MkdirAll before opening the store.
+func AutoCreate(autoCreate bool) Arg {
+	return func(d *driver) {
+		d.autoCreate = autoCreate
+	}
+}
+
+// WithRegisterer sets the Prometheus registerer the underlying Badger store
+// reports its metrics to. Defaults to prometheus.NewRegistry(), a private
+// registry, so that opening a disk driver doesn't require the caller to
+// have one set up.
+func WithRegisterer(reg prometheus.Registerer) Arg {
+	return func(d *driver) {
+		d.registerer = reg
+	}
+}
+
+// Partitions declares storage paths that should be stored as separate
+// Badger keys rather than nested under a single root document, mirroring
+// the `storage.disk.partitions` config in upstream OPA.
+func Partitions(partitions []storage.Path) Arg {
+	return func(d *driver) {
+		d.opts.Partitions = partitions
+	}
+}
+
+// Tracing enables topdown trace collection on every query.
+func Tracing(enabled bool) Arg {
+	return func(d *driver) {
+		d.traceEnabled = enabled
+	}
+}
+
+// WithMetrics registers a hook invoked after each storage operation.
+func WithMetrics(hook MetricsHook) Arg {
+	return func(d *driver) {
+		d.metrics = hook
+	}
+}
+
+// New opens (or creates) the on-disk store at the configured directory and
+// returns a drivers.Driver backed by it. Unlike local.New, this can fail:
+// opening the underlying Badger database is an I/O operation.
+func New(ctx context.Context, args ...Arg) (drivers.Driver, error) {
+	d := &driver{
+		compiler:   ast.NewCompiler(),
+		modules:    make(map[string]*ast.Module),
+		registerer: prometheus.NewRegistry(),
+	}
+	for _, arg := range args {
+		arg(d)
+	}
+
+	if d.autoCreate {
+		if err := os.MkdirAll(d.opts.Dir, 0o755); err != nil {
+			return nil, errors.Wrap(err, "creating disk store directory")
+		}
+	}
+
+	store, err := disk.New(ctx, logging.NewNoOpLogger(), d.registerer, d.opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening disk store")
+	}
+	d.storage = store
+	ps := &storagePolicyStore{storage: store}
+	// WithAsyncPolicyStore ran before the store existed, so its async store
+	// was built with no underlying store; give it the real one now.
+	if a, ok := d.policyStore.(*asyncPolicyStore); ok {
+		a.underlying = ps
+	} else {
+		d.policyStore = ps
+	}
+	return d, nil
+}
+
+var _ drivers.Driver = &driver{}
+
+type driver struct {
+	modulesMux   sync.RWMutex
+	compiler     *ast.Compiler
+	modules      map[string]*ast.Module
+	storage      storage.Store
+	policyStore  policyStore
+	traceEnabled bool
+	metrics      MetricsHook
+	opts         disk.Options
+	autoCreate   bool
+	registerer   prometheus.Registerer
+}
+
+func (d *driver) observe(op string, start time.Time) {
+	if d.metrics != nil {
+		d.metrics(op, time.Since(start))
+	}
+}
+
+// Init replays the policies already persisted on disk (from a prior process)
+// into the in-memory compiler so that queries see a consistent view
+// immediately after startup, without requiring the caller to re-PutModule
+// everything.
+func (d *driver) Init(ctx context.Context) error {
+	d.modulesMux.Lock()
+	defer d.modulesMux.Unlock()
+
+	defer d.observe("init", time.Now())
+
+	txn, err := d.storage.NewTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.storage.Abort(ctx, txn)
+
+	ids, err := d.storage.ListPolicies(ctx, txn)
+	if err != nil {
+		return err
+	}
+
+	modules := make(map[string]*ast.Module, len(ids))
+	texts := make(map[string]string, len(ids))
+	for _, id := range ids {
+		bs, err := d.storage.GetPolicy(ctx, txn, id)
+		if err != nil {
+			return err
+		}
+		m, err := ast.ParseModule(id, string(bs))
+		if err != nil {
+			return errors.Wrapf(err, "replaying policy %q", id)
+		}
+		modules[id] = m
+		texts[id] = string(bs)
+	}
+
+	c := ast.NewCompiler().WithPathConflictsCheck(storage.NonEmpty(ctx, d.storage, txn))
+	if c.Compile(modules); c.Failed() {
+		return c.Errors
+	}
+	d.compiler = c
+	d.modules = modules
+	return nil
+}
+
+func copyModules(modules map[string]*ast.Module, filter string) map[string]*ast.Module {
+	m := make(map[string]*ast.Module, len(modules))
+	for k, v := range modules {
+		if filter != "" && k == filter {
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func (d *driver) checkModuleName(name string) error {
+	if name == "" {
+		return errors.Errorf("Module name cannot be empty")
+	}
+	return nil
+}
+
+func (d *driver) PutModule(ctx context.Context, name string, src string) error {
+	if err := d.checkModuleName(name); err != nil {
+		return err
+	}
+	insert := insertParam{}
+	if err := insert.add(name, src); err != nil {
+		return err
+	}
+	d.modulesMux.Lock()
+	defer d.modulesMux.Unlock()
+	_, err := d.alterModules(ctx, insert, nil)
+	return err
+}
+
+// DeleteModule deletes a rule from OPA and returns true if a rule was found and deleted, false
+// if a rule was not found, and any errors
+func (d *driver) DeleteModule(ctx context.Context, name string) (bool, error) {
+	if err := d.checkModuleName(name); err != nil {
+		return false, err
+	}
+	d.modulesMux.Lock()
+	defer d.modulesMux.Unlock()
+	if _, found := d.modules[name]; !found {
+		return false, nil
+	}
+	count, err := d.alterModules(ctx, nil, []string{name})
+	return count == 1, err
+}
+
+// alterModules alters the modules in the driver by inserting and removing
+// the provided modules then returns the count of modules removed.
+// alterModules expects that the caller is holding the modulesMux lock, which
+// also keeps writes from racing with trigger execution during eval.
+//
+// Compilation happens first, against the in-memory module set only, so a
+// failing change never touches the policyStore mirror. The mirror is then
+// persisted, and only once that succeeds does the in-memory compiler swap
+// in, so served state never gets ahead of what's durable. With
+// WithAsyncPolicyStore, the mirror write is enqueued rather than waited on,
+// so the swap still happens as soon as the compile does.
+func (d *driver) alterModules(ctx context.Context, insert insertParam, remove []string) (int, error) {
+	defer d.observe("alter_modules", time.Now())
+
+	updatedModules := copyModules(d.modules, "")
+	for _, name := range remove {
+		delete(updatedModules, name)
+	}
+	for name, mod := range insert {
+		updatedModules[name] = mod.parsed
+	}
+
+	txn, err := d.storage.NewTransaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	c := ast.NewCompiler().WithPathConflictsCheck(storage.NonEmpty(ctx, d.storage, txn))
+	c.Compile(updatedModules)
+	d.storage.Abort(ctx, txn)
+	if c.Failed() {
+		return 0, c.Errors
+	}
+
+	// The precheck transaction above must be closed before this call: it's
+	// a read transaction on the same store, and policyStore.Alter opens its
+	// own write transaction, which would otherwise deadlock against it.
+	if err := d.policyStore.Alter(ctx, insert, remove); err != nil {
+		return 0, err
+	}
+
+	d.compiler = c
+	d.modules = updatedModules
+	return len(remove), nil
+}
+
+// bundleDataPath derives the storage path a bundle's data.json entry should
+// be written under from its tarball path, e.g. "a/b/data.json" -> "/a/b".
+func bundleDataPath(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	dir := strings.TrimSuffix(name, "data.json")
+	dir = strings.Trim(dir, "/")
+	return "/" + dir
+}
+
+// writeDataEntry commits a single bundle data.json subtree in its own
+// transaction, rather than holding it in a transaction spanning the whole
+// bundle, so the pending-update list never grows past one document.
+func (d *driver) writeDataEntry(ctx context.Context, p storage.Path, v interface{}) error {
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+	if len(p) > 0 {
+		if err := storage.MakeDir(ctx, d.storage, txn, p[:len(p)-1]); err != nil {
+			d.storage.Abort(ctx, txn)
+			return err
+		}
+	}
+	if err := d.storage.Write(ctx, txn, storage.AddOp, p, v); err != nil {
+		d.storage.Abort(ctx, txn)
+		return err
+	}
+	return d.storage.Commit(ctx, txn)
+}
+
+// LoadBundle loads an OPA bundle tarball the same way the local driver
+// does: policies are staged through the usual parse path and each data.json
+// is decoded and committed into the on-disk store as its own subtree, in
+// its own transaction, as soon as it's read, so memory use tracks the
+// largest single document rather than the size of the bundle as a whole.
+// The tradeoff is that a bundle is no longer applied atomically as a whole:
+// if the tarball is truncated, fails manifest verification, or the policy
+// set it carries fails to compile partway through, any data subtrees
+// already committed stay committed. Policy is unaffected by this tradeoff:
+// modules are only parsed and staged here, and are compiled and written in
+// one transaction at the end, same as before.
+func (d *driver) LoadBundle(ctx context.Context, r io.Reader, opts ...drivers.BundleOpt) error {
+	defer d.observe("load_bundle", time.Now())
+
+	cfg := &drivers.BundleCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "opening bundle")
+	}
+	tr := tar.NewReader(gz)
+
+	d.modulesMux.Lock()
+	defer d.modulesMux.Unlock()
+
+	insert := insertParam{}
+	manifestSeen := cfg.VerifyManifest == nil
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading bundle tarball")
+		}
+		name := strings.TrimPrefix(hdr.Name, "/")
+
+		switch {
+		case name == ".manifest":
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if cfg.VerifyManifest != nil {
+				if err := cfg.VerifyManifest(bs); err != nil {
+					return errors.Wrap(err, "verifying bundle manifest")
+				}
+				manifestSeen = true
+			}
+		case name == "signatures.json" || name == ".signatures.json":
+			if cfg.VerifySignatures != nil {
+				bs, err := io.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				if err := cfg.VerifySignatures(bs); err != nil {
+					return errors.Wrap(err, "verifying bundle signatures")
+				}
+			}
+		case strings.HasSuffix(name, ".rego"):
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err := insert.add(name, string(bs)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, "data.json"):
+			var v interface{}
+			if err := json.NewDecoder(tr).Decode(&v); err != nil {
+				return errors.Wrapf(err, "decoding %s", name)
+			}
+			p, err := parsePath(bundleDataPath(name))
+			if err != nil {
+				return err
+			}
+			if err := d.writeDataEntry(ctx, p, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !manifestSeen {
+		return errors.New("bundle is missing a .manifest required for verification")
+	}
+
+	updatedModules := copyModules(d.modules, "")
+	for name, mod := range insert {
+		updatedModules[name] = mod.parsed
+	}
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+	c := ast.NewCompiler().WithPathConflictsCheck(storage.NonEmpty(ctx, d.storage, txn))
+	if c.Compile(updatedModules); c.Failed() {
+		d.storage.Abort(ctx, txn)
+		return c.Errors
+	}
+	for name, mod := range insert {
+		if err := d.storage.UpsertPolicy(ctx, txn, name, []byte(mod.text)); err != nil {
+			d.storage.Abort(ctx, txn)
+			return err
+		}
+	}
+	if err := d.storage.Commit(ctx, txn); err != nil {
+		return err
+	}
+	d.compiler = c
+	d.modules = updatedModules
+	return nil
+}
+
+func parsePath(path string) ([]string, error) {
+	p, ok := storage.ParsePathEscaped(path)
+	if !ok {
+		return nil, fmt.Errorf("Bad data path: %s", path)
+	}
+	return p, nil
+}
+
+func (d *driver) PutData(ctx context.Context, path string, data interface{}) error {
+	defer d.observe("put_data", time.Now())
+
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+	p, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+	if _, err := d.storage.Read(ctx, txn, p); err != nil {
+		if storage.IsNotFound(err) {
+			if len(p) > 0 {
+				if err := storage.MakeDir(ctx, d.storage, txn, p[:len(p)-1]); err != nil {
+					d.storage.Abort(ctx, txn)
+					return err
+				}
+			}
+		} else {
+			d.storage.Abort(ctx, txn)
+			return err
+		}
+	}
+	if err := d.storage.Write(ctx, txn, storage.AddOp, p, data); err != nil {
+		d.storage.Abort(ctx, txn)
+		return err
+	}
+	if err := ast.CheckPathConflicts(d.compiler, storage.NonEmpty(ctx, d.storage, txn)); len(err) > 0 {
+		d.storage.Abort(ctx, txn)
+		return err
+	}
+	if err := d.storage.Commit(ctx, txn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteData deletes data from OPA and returns true if data was found and deleted, false
+// if data was not found, and any errors
+func (d *driver) DeleteData(ctx context.Context, path string) (bool, error) {
+	defer d.observe("delete_data", time.Now())
+
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+	p, err := parsePath(path)
+	if err != nil {
+		return false, err
+	}
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return false, err
+	}
+	if err := d.storage.Write(ctx, txn, storage.RemoveOp, p, interface{}(nil)); err != nil {
+		d.storage.Abort(ctx, txn)
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := d.storage.Commit(ctx, txn); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *driver) eval(ctx context.Context, path string, input interface{}, cfg *drivers.QueryCfg) (rego.ResultSet, *string, error) {
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+	args := []func(*rego.Rego){
+		rego.Compiler(d.compiler),
+		rego.Store(d.storage),
+		rego.Input(input),
+		rego.Query(path),
+	}
+	if d.traceEnabled || cfg.TracingEnabled {
+		buf := topdown.NewBufferTracer()
+		args = append(args, rego.Tracer(buf))
+		rego := rego.New(args...)
+		res, err := rego.Eval(ctx)
+		b := &bytes.Buffer{}
+		topdown.PrettyTrace(b, *buf)
+		t := b.String()
+		return res, &t, err
+	}
+	rego := rego.New(args...)
+	res, err := rego.Eval(ctx)
+	return res, nil, err
+}
+
+func (d *driver) Query(ctx context.Context, path string, input interface{}, opts ...drivers.QueryOpt) (*drivers.Response, error) {
+	defer d.observe("query", time.Now())
+
+	cfg := &drivers.QueryCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	inp, err := json.MarshalIndent(input, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+	rs, trace, err := d.eval(ctx, path, input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	i := string(inp)
+	return &drivers.Response{
+		Trace:   trace,
+		Results: &rs,
+		Input:   &i,
+	}, nil
+}
+
+// Compile partially evaluates query, treating the given paths as unknown,
+// and returns the residual queries and support modules rather than a final
+// result. This mirrors OPA's /v1/compile endpoint.
+func (d *driver) Compile(ctx context.Context, query string, unknowns []string, input interface{}) (*drivers.CompileResponse, error) {
+	defer d.observe("compile", time.Now())
+
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+
+	unknownRefs := make([]*ast.Term, len(unknowns))
+	for i, u := range unknowns {
+		term, err := ast.ParseTerm(u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing unknown %q", u)
+		}
+		unknownRefs[i] = term
+	}
+
+	r := rego.New(
+		rego.Compiler(d.compiler),
+		rego.Store(d.storage),
+		rego.Query(query),
+		rego.ParsedUnknowns(unknownRefs),
+		rego.Input(input),
+	)
+	pq, err := r.Partial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &drivers.CompileResponse{
+		Queries: pq.Queries,
+		Support: pq.Support,
+	}, nil
+}
+
+func (d *driver) Dump(ctx context.Context) (string, error) {
+	defer d.observe("dump", time.Now())
+
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+	mods := make(map[string]string, len(d.modules))
+	for k, v := range d.modules {
+		mods[k] = v.String()
+	}
+	data, _, err := d.eval(ctx, "data", nil, &drivers.QueryCfg{})
+	if err != nil {
+		return "", err
+	}
+	var dt interface{}
+	// There should be only 1 or 0 expression values
+	if len(data) > 1 {
+		return "", errors.New("Too many dump results")
+	}
+	for _, da := range data {
+		if len(data) > 1 {
+			return "", errors.New("Too many expressions results")
+		}
+		for _, e := range da.Expressions {
+			dt = e.Value
+		}
+	}
+	resp := map[string]interface{}{
+		"modules": mods,
+		"data":    dt,
+	}
+	b, err := json.MarshalIndent(resp, "", "   ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
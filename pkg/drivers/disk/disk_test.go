@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"testing"
+)
+
+// buildBundle writes a minimal OPA bundle tarball with a single root
+// data.json, the ordinary, spec-legal layout that used to panic LoadBundle.
+func buildBundle(t *testing.T, n, sz int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	manifest := []byte(`{"revision":"test"}`)
+	if err := tw.WriteHeader(&tar.Header{Name: ".manifest", Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	data := &bytes.Buffer{}
+	data.WriteByte('{')
+	val := bytes.Repeat([]byte("x"), sz)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			data.WriteByte(',')
+		}
+		fmt.Fprintf(data, "%q:%q", fmt.Sprintf("k%d", i), val)
+	}
+	data.WriteByte('}')
+	if err := tw.WriteHeader(&tar.Header{Name: "data.json", Size: int64(data.Len())}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildLargeBundle writes n separate "dirK/data.json" subtrees, each a
+// single sz-byte string value, instead of one big document, so the total
+// bundle size can be scaled up without any single data.json growing past
+// sz, and without blowing past Badger's internal per-transaction size
+// limit the way one giant combined document would.
+func buildLargeBundle(t *testing.T, n, sz int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	manifest := []byte(`{"revision":"test"}`)
+	if err := tw.WriteHeader(&tar.Header{Name: ".manifest", Size: int64(len(manifest))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := append([]byte{'"'}, append(bytes.Repeat([]byte("x"), sz), '"')...)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("dir%d/data.json", i)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(doc))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestLoadBundleSingleTransactionWouldFail pins down why writeDataEntry
+// commits each data.json subtree in its own transaction instead of one
+// transaction for the whole bundle: Badger rejects a transaction once its
+// pending writes grow past its per-transaction size limit, and a single
+// data.json is written in one transaction. A bundle carrying all of the
+// keys in a single root document hits the limit; the same data split
+// across separate data.json subtrees, each committed as it's read, does
+// not.
+func TestLoadBundleSingleTransactionWouldFail(t *testing.T) {
+	ctx := context.Background()
+
+	const keys = 2000
+	const keySize = 64 * 1024 // 64KiB each, ~128MiB total either way
+
+	single, err := New(ctx, Dir(t.TempDir()), AutoCreate(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := single.LoadBundle(ctx, bytes.NewReader(buildBundle(t, keys, keySize))); err == nil {
+		t.Fatal("LoadBundle with all keys in one data.json: expected Badger's per-transaction size limit to reject this, got nil error")
+	}
+
+	split, err := New(ctx, Dir(t.TempDir()), AutoCreate(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := split.LoadBundle(ctx, bytes.NewReader(buildLargeBundle(t, keys, keySize))); err != nil {
+		t.Fatalf("LoadBundle with keys split across data.json subtrees: %v", err)
+	}
+}
+
+// TestLoadBundleRootDataJSON is a regression test for the panic a
+// root-level data.json used to cause: bundleDataPath("data.json") is "/",
+// which parses to an empty storage.Path, and indexing p[:len(p)-1] on that
+// used to panic instead of being treated as "nothing to MakeDir".
+func TestLoadBundleRootDataJSON(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(ctx, Dir(t.TempDir()), AutoCreate(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	bundle := buildBundle(t, 1, 16)
+	if err := d.LoadBundle(ctx, bytes.NewReader(bundle)); err != nil {
+		t.Fatalf("LoadBundle: %v", err)
+	}
+}
+
+// TestPutDataRoot is the same root-path regression as
+// TestLoadBundleRootDataJSON, but for PutData's own MakeDir call.
+func TestPutDataRoot(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(ctx, Dir(t.TempDir()), AutoCreate(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := d.PutData(ctx, "/", map[string]interface{}{"a": 1}); err != nil {
+		t.Fatalf("PutData: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package disk
+
+import (
+	"context"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// policyStore mirrors policy text into durable storage on behalf of
+// alterModules, decoupled from the in-memory compile that callers actually
+// wait on. This lets PutModule pay storage overhead only if/when the
+// mirror is flushed, rather than inline with every call.
+//
+// This is the same interface, and largely the same implementation, as
+// local's policyStore. They're kept as separate unexported types per
+// package rather than factored out because local and disk haven't needed
+// to share any other internals; if that changes, this is a good candidate
+// to move into a shared internal package.
+type policyStore interface {
+	Alter(ctx context.Context, insert insertParam, remove []string) error
+}
+
+// storagePolicyStore is the default policyStore: it writes straight
+// through to the driver's storage.Store in one transaction, synchronously.
+type storagePolicyStore struct {
+	storage storage.Store
+}
+
+func (s *storagePolicyStore) Alter(ctx context.Context, insert insertParam, remove []string) error {
+	txn, err := s.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+	for _, name := range remove {
+		if err := s.storage.DeletePolicy(ctx, txn, name); err != nil {
+			s.storage.Abort(ctx, txn)
+			return err
+		}
+	}
+	for name, mod := range insert {
+		if err := s.storage.UpsertPolicy(ctx, txn, name, []byte(mod.text)); err != nil {
+			s.storage.Abort(ctx, txn)
+			return err
+		}
+	}
+	return s.storage.Commit(ctx, txn)
+}
+
+// policyJob is one alterModules storage mirror to apply, queued for an
+// asyncPolicyStore's background worker.
+type policyJob struct {
+	insert insertParam
+	remove []string
+}
+
+// asyncPolicyStore queues policy mirror writes onto a background goroutine
+// so that PutModule/DeleteModule can return as soon as the compiler has
+// been swapped, without waiting on storage. If the queue is ever full, it
+// falls back to a synchronous write rather than silently dropping a
+// change.
+type asyncPolicyStore struct {
+	underlying policyStore
+	jobs       chan policyJob
+	onError    func(error)
+}
+
+func newAsyncPolicyStore(underlying policyStore, onError func(error)) *asyncPolicyStore {
+	if onError == nil {
+		onError = func(error) {}
+	}
+	a := &asyncPolicyStore{
+		underlying: underlying,
+		jobs:       make(chan policyJob, 64),
+		onError:    onError,
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncPolicyStore) run() {
+	for job := range a.jobs {
+		if err := a.underlying.Alter(context.Background(), job.insert, job.remove); err != nil {
+			a.onError(err)
+		}
+	}
+}
+
+func (a *asyncPolicyStore) Alter(ctx context.Context, insert insertParam, remove []string) error {
+	select {
+	case a.jobs <- policyJob{insert: insert, remove: remove}:
+		return nil
+	default:
+		return a.underlying.Alter(ctx, insert, remove)
+	}
+}
+
+// WithAsyncPolicyStore makes alterModules mirror policy text into storage
+// on a background goroutine instead of inline with PutModule/DeleteModule.
+// onError, if non-nil, is called with any error from a queued write; it may
+// be nil to discard them.
+func WithAsyncPolicyStore(onError func(error)) Arg {
+	return func(d *driver) {
+		d.policyStore = newAsyncPolicyStore(d.policyStore, onError)
+	}
+}
@@ -2,17 +2,48 @@ package drivers
 
 import (
 	"context"
+	"io"
 )
 
-//QueryCfg configuration for QueryOpt.
+// QueryCfg configuration for QueryOpt.
 type QueryCfg struct {
 	TracingEnabled bool
+	// Target, if set, tells a MultiDriver which target's underlying
+	// Driver should handle the query instead of its default target.
+	Target string
 }
 
-//QueryOpt options for opa query.
+// QueryOpt options for opa query.
 type QueryOpt func(*QueryCfg)
 
-//Driver driver for opa integration
+// WithTarget is a QueryOpt that routes a query to a specific target on a
+// MultiDriver. It is a no-op on a single-target Driver.
+func WithTarget(target string) QueryOpt {
+	return func(cfg *QueryCfg) {
+		cfg.Target = target
+	}
+}
+
+// BundleCfg configuration for BundleOpt.
+type BundleCfg struct {
+	// VerifyManifest is called with the raw manifest bytes when the
+	// .manifest entry is read from the tarball, allowing callers to reject
+	// a bundle whose manifest doesn't match what they expect (e.g. wrong
+	// revision). Data files that come before .manifest in the tarball are
+	// already written to storage by then.
+	VerifyManifest func(manifest []byte) error
+	// VerifySignatures is called with the raw signatures.json bytes, if
+	// present, when that entry is read from the tarball. Data files that
+	// come before it in the tarball are already written to storage by then.
+	// Callers supply their own JWS verification (e.g. against a known
+	// public key) rather than the driver hardcoding one.
+	VerifySignatures func(signatures []byte) error
+}
+
+// BundleOpt options for LoadBundle.
+type BundleOpt func(*BundleCfg)
+
+// Driver driver for opa integration
 type Driver interface {
 	Init(ctx context.Context) error
 
@@ -23,7 +54,16 @@ type Driver interface {
 	PutData(ctx context.Context, path string, data interface{}) error
 	DeleteData(ctx context.Context, path string) (bool, error)
 
+	// LoadBundle loads an OPA bundle tarball, streaming its data files
+	// into storage one subtree at a time instead of deserializing the
+	// whole bundle into memory up front.
+	LoadBundle(ctx context.Context, r io.Reader, opts ...BundleOpt) error
+
 	Query(ctx context.Context, path string, input interface{}, opts ...QueryOpt) (*Response, error)
 
+	// Compile partially evaluates query against unknowns, returning the
+	// residual queries/support modules rather than a final result.
+	Compile(ctx context.Context, query string, unknowns []string, input interface{}) (*CompileResponse, error)
+
 	Dump(ctx context.Context) (string, error)
 }
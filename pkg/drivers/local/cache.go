@@ -0,0 +1,136 @@
+package local
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// Strategy is a pluggable eviction policy for the prepared query cache. It
+// is invoked under only the driver's modulesMux read lock, from concurrent
+// Query, PutData and DeleteData calls, so implementations must be safe for
+// concurrent use on their own.
+type Strategy interface {
+	// Get returns the cached prepared query for key, if present, and
+	// records the access for eviction-ordering purposes.
+	Get(key string) (*rego.PreparedEvalQuery, bool)
+	// Put inserts or replaces the prepared query for key, evicting an
+	// entry if the cache is at capacity.
+	Put(key string, q *rego.PreparedEvalQuery)
+	// Purge drops every cached entry, e.g. because the compiler changed.
+	Purge()
+}
+
+// lfuEntry is a single cached prepared query, with the access frequency
+// whose list it currently lives in.
+type lfuEntry struct {
+	key   string
+	query *rego.PreparedEvalQuery
+	freq  int
+}
+
+// lfuCache is a classic O(1) LFU cache: a map from key to entry, plus a map
+// from frequency to a doubly-linked list of entries at that frequency. A
+// hit moves the entry to the freq+1 list; eviction pops the least-recently-
+// used entry off the minFreq list. It is safe for concurrent use: PutData,
+// DeleteData and Query all run under the driver's modulesMux read lock, so
+// the cache needs its own mutex rather than relying on that one.
+type lfuCache struct {
+	mu       sync.Mutex
+	capacity int
+	minFreq  int
+	entries  map[string]*list.Element
+	freqs    map[int]*list.List
+}
+
+// NewLFUCache returns a Strategy that keeps at most capacity prepared
+// queries, evicting the least-frequently (and, among ties, least-recently)
+// used entry once that capacity is exceeded.
+func NewLFUCache(capacity int) Strategy {
+	return &lfuCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element, capacity),
+		freqs:    make(map[int]*list.List),
+	}
+}
+
+func (c *lfuCache) Get(key string) (*rego.PreparedEvalQuery, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lfuEntry)
+	c.touch(el, e)
+	return e.query, true
+}
+
+func (c *lfuCache) Put(key string, q *rego.PreparedEvalQuery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lfuEntry)
+		e.query = q
+		c.touch(el, e)
+		return
+	}
+	if len(c.entries) >= c.capacity {
+		c.evict()
+	}
+	e := &lfuEntry{key: key, query: q, freq: 1}
+	l, ok := c.freqs[1]
+	if !ok {
+		l = list.New()
+		c.freqs[1] = l
+	}
+	c.entries[key] = l.PushFront(e)
+	c.minFreq = 1
+}
+
+func (c *lfuCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element, c.capacity)
+	c.freqs = make(map[int]*list.List)
+	c.minFreq = 0
+}
+
+// touch moves e from its current frequency list to freq+1, bumping minFreq
+// forward if the list it left becomes empty and was the least-frequent.
+func (c *lfuCache) touch(el *list.Element, e *lfuEntry) {
+	old := c.freqs[e.freq]
+	old.Remove(el)
+	if old.Len() == 0 {
+		delete(c.freqs, e.freq)
+		if c.minFreq == e.freq {
+			c.minFreq++
+		}
+	}
+	e.freq++
+	l, ok := c.freqs[e.freq]
+	if !ok {
+		l = list.New()
+		c.freqs[e.freq] = l
+	}
+	c.entries[e.key] = l.PushFront(e)
+}
+
+// evict removes the least-recently-used entry from the minFreq list.
+func (c *lfuCache) evict() {
+	l, ok := c.freqs[c.minFreq]
+	if !ok || l.Len() == 0 {
+		return
+	}
+	back := l.Back()
+	e := back.Value.(*lfuEntry)
+	l.Remove(back)
+	if l.Len() == 0 {
+		delete(c.freqs, c.minFreq)
+	}
+	delete(c.entries, e.key)
+}
@@ -1,11 +1,17 @@
 package local
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/luckoseabraham/opa-driver/pkg/drivers"
 
@@ -14,7 +20,11 @@ import (
 	"github.com/open-policy-agent/opa/storage"
 	"github.com/open-policy-agent/opa/storage/inmem"
 	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/tracing"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type module struct {
@@ -41,11 +51,62 @@ func Tracing(enabled bool) Arg {
 	}
 }
 
+// defaultTarget is the target name reported on Response.Target when the
+// driver wasn't given one via WithTarget, matching upstream OPA's default
+// "rego" evaluator target.
+const defaultTarget = "rego"
+
+// WithTarget sets the name this driver reports on Response.Target, so that
+// a MultiDriver hosting several targets can tell which one answered.
+func WithTarget(target string) Arg {
+	return func(d *driver) {
+		d.target = target
+	}
+}
+
+// WithQueryCache enables a prepared-query cache of the given capacity,
+// using the default LFU eviction strategy.
+func WithQueryCache(capacity int) Arg {
+	return func(d *driver) {
+		d.queryCache = NewLFUCache(capacity)
+	}
+}
+
+// WithCacheStrategy sets the prepared-query cache's eviction strategy,
+// overriding the LFU default set by WithQueryCache.
+func WithCacheStrategy(s Strategy) Arg {
+	return func(d *driver) {
+		d.queryCache = s
+	}
+}
+
+// WithPartialTranslator makes Compile translate its residual queries and
+// support modules through t, e.g. into SQL or an Elasticsearch DSL filter.
+func WithPartialTranslator(t drivers.PartialTranslator) Arg {
+	return func(d *driver) {
+		d.translator = t
+	}
+}
+
+// WithTracerProvider has every Driver method except Init emit OpenTelemetry
+// spans through tp, with OPA's own topdown evaluation spans nested underneath
+// via rego.DistributedTracingOpts. Init does nothing and emits no span. This
+// mirrors the distributed_tracing config key in upstream OPA.
+func WithTracerProvider(tp trace.TracerProvider) Arg {
+	return func(d *driver) {
+		d.tracerProvider = tp
+	}
+}
+
 func New(args ...Arg) drivers.Driver {
+	s := inmem.New()
 	d := &driver{
-		compiler: ast.NewCompiler(),
-		modules:  make(map[string]*ast.Module),
-		storage:  inmem.New(),
+		compiler:       ast.NewCompiler(),
+		modules:        make(map[string]*ast.Module),
+		storage:        s,
+		policyStore:    &storagePolicyStore{storage: s},
+		tracerProvider: trace.NewNoopTracerProvider(),
+		target:         defaultTarget,
 	}
 	for _, arg := range args {
 		arg(d)
@@ -56,11 +117,38 @@ func New(args ...Arg) drivers.Driver {
 var _ drivers.Driver = &driver{}
 
 type driver struct {
-	modulesMux   sync.RWMutex
-	compiler     *ast.Compiler
-	modules      map[string]*ast.Module
-	storage      storage.Store
-	traceEnabled bool
+	modulesMux     sync.RWMutex
+	compiler       *ast.Compiler
+	compilerRev    uint64
+	modules        map[string]*ast.Module
+	storage        storage.Store
+	policyStore    policyStore
+	traceEnabled   bool
+	queryCache     Strategy
+	translator     drivers.PartialTranslator
+	tracerProvider trace.TracerProvider
+	target         string
+}
+
+// tracer returns the driver's configured tracer, defaulting to a no-op one
+// when WithTracerProvider was not supplied.
+func (d *driver) tracer() trace.Tracer {
+	return d.tracerProvider.Tracer("github.com/luckoseabraham/opa-driver/pkg/drivers/local")
+}
+
+// distributedTracingOpts configures a rego.Rego instance to nest OPA's own
+// topdown evaluation spans under whatever span is active on ctx.
+func (d *driver) distributedTracingOpts() func(*rego.Rego) {
+	return rego.DistributedTracingOpts(tracing.NewOptions(d.tracerProvider))
+}
+
+// recordErr records err on span, if non-nil, and marks the span as failed.
+func recordErr(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
 }
 
 func (d *driver) Init(ctx context.Context) error {
@@ -86,24 +174,30 @@ func (d *driver) checkModuleName(name string) error {
 }
 
 func (d *driver) PutModule(ctx context.Context, name string, src string) error {
+	ctx, span := d.tracer().Start(ctx, "local.PutModule", trace.WithAttributes(attribute.String("opa.module", name)))
+	defer span.End()
+
 	if err := d.checkModuleName(name); err != nil {
-		return err
+		return recordErr(span, err)
 	}
 	insert := insertParam{}
 	if err := insert.add(name, src); err != nil {
-		return err
+		return recordErr(span, err)
 	}
 	d.modulesMux.Lock()
 	defer d.modulesMux.Unlock()
 	_, err := d.alterModules(ctx, insert, nil)
-	return err
+	return recordErr(span, err)
 }
 
 // DeleteModule deletes a rule from OPA and returns true if a rule was found and deleted, false
 // if a rule was not found, and any errors
 func (d *driver) DeleteModule(ctx context.Context, name string) (bool, error) {
+	ctx, span := d.tracer().Start(ctx, "local.DeleteModule", trace.WithAttributes(attribute.String("opa.module", name)))
+	defer span.End()
+
 	if err := d.checkModuleName(name); err != nil {
-		return false, err
+		return false, recordErr(span, err)
 	}
 	d.modulesMux.Lock()
 	defer d.modulesMux.Unlock()
@@ -111,51 +205,231 @@ func (d *driver) DeleteModule(ctx context.Context, name string) (bool, error) {
 		return false, nil
 	}
 	count, err := d.alterModules(ctx, nil, []string{name})
-	return count == 1, err
+	return count == 1, recordErr(span, err)
 }
 
 // alterModules alters the modules in the driver by inserting and removing
 // the provided modules then returns the count of modules removed.
 // alterModules expects that the caller is holding the modulesMux lock.
+//
+// Compilation happens first, against the in-memory module set only, so a
+// failing change never touches the policyStore mirror. The mirror is then
+// persisted, and only once that succeeds does the in-memory compiler swap
+// in, so served state never gets ahead of what's durable. With
+// WithAsyncPolicyStore, the mirror write is enqueued rather than waited on,
+// so the swap still happens as soon as the compile does.
 func (d *driver) alterModules(ctx context.Context, insert insertParam, remove []string) (int, error) {
+	ctx, span := d.tracer().Start(ctx, "local.alterModules")
+	defer span.End()
+
 	updatedModules := copyModules(d.modules, "")
 	for _, name := range remove {
 		delete(updatedModules, name)
 	}
+	bytesWritten := 0
 	for name, mod := range insert {
 		updatedModules[name] = mod.parsed
+		bytesWritten += len(mod.text)
 	}
+	span.SetAttributes(
+		attribute.Int("opa.modules.inserted", len(insert)),
+		attribute.Int("opa.modules.removed", len(remove)),
+		attribute.Int("opa.policy.bytes_written", bytesWritten),
+	)
 
-	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	txn, err := d.storage.NewTransaction(ctx)
 	if err != nil {
-		return 0, err
+		return 0, recordErr(span, err)
 	}
 
-	for _, name := range remove {
-		if err := d.storage.DeletePolicy(ctx, txn, name); err != nil {
+	compileStart := time.Now()
+	c := ast.NewCompiler().WithPathConflictsCheck(storage.NonEmpty(ctx, d.storage, txn))
+	c.Compile(updatedModules)
+	d.storage.Abort(ctx, txn)
+	if c.Failed() {
+		return 0, recordErr(span, c.Errors)
+	}
+	span.SetAttributes(attribute.Int64("opa.compile.duration_ms", time.Since(compileStart).Milliseconds()))
+
+	// The precheck transaction above must be closed before this call: it's
+	// a read transaction on the same store, and policyStore.Alter opens its
+	// own write transaction, which would otherwise deadlock against it.
+	if err := d.policyStore.Alter(ctx, insert, remove); err != nil {
+		return 0, recordErr(span, err)
+	}
+
+	d.compiler = c
+	d.modules = updatedModules
+	d.invalidateQueryCache()
+	return len(remove), nil
+}
+
+// invalidateQueryCache drops every prepared query and bumps the compiler
+// revision, so that any key computed against the old compiler is never
+// looked up again. PutData/DeleteData call this under only a read lock, so
+// the revision is bumped atomically rather than relying on modulesMux for
+// exclusivity here.
+func (d *driver) invalidateQueryCache() {
+	atomic.AddUint64(&d.compilerRev, 1)
+	if d.queryCache != nil {
+		d.queryCache.Purge()
+	}
+}
+
+// bundleDataPath derives the storage path a bundle's data.json entry should
+// be written under from its tarball path, e.g. "a/b/data.json" -> "/a/b".
+func bundleDataPath(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	dir := strings.TrimSuffix(name, "data.json")
+	dir = strings.Trim(dir, "/")
+	return "/" + dir
+}
+
+// writeDataEntry commits a single bundle data.json subtree in its own
+// transaction, rather than holding it in a transaction spanning the whole
+// bundle, so the pending-update list never grows past one document.
+func (d *driver) writeDataEntry(ctx context.Context, p storage.Path, v interface{}) error {
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
+	if len(p) > 0 {
+		if err := storage.MakeDir(ctx, d.storage, txn, p[:len(p)-1]); err != nil {
 			d.storage.Abort(ctx, txn)
-			return 0, err
+			return err
 		}
 	}
+	if err := d.storage.Write(ctx, txn, storage.AddOp, p, v); err != nil {
+		d.storage.Abort(ctx, txn)
+		return err
+	}
+	return d.storage.Commit(ctx, txn)
+}
+
+// LoadBundle loads an OPA bundle tarball without first deserializing the
+// whole thing into memory: policy files are parsed and staged the same way
+// PutModule does, while each data.json is decoded and committed into
+// storage as its own subtree, in its own transaction, as soon as it's read,
+// so memory use tracks the largest single document rather than the size of
+// the bundle as a whole. The tradeoff is that a bundle is no longer applied
+// atomically as a whole: if the tarball is truncated, fails manifest
+// verification, or the policy set it carries fails to compile partway
+// through, any data subtrees already committed stay committed. Policy is
+// unaffected by this tradeoff: modules are only parsed and staged here, and
+// are compiled and written in one transaction at the end, same as before.
+func (d *driver) LoadBundle(ctx context.Context, r io.Reader, opts ...drivers.BundleOpt) (err error) {
+	ctx, span := d.tracer().Start(ctx, "local.LoadBundle")
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
+	cfg := &drivers.BundleCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
 
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "opening bundle")
+	}
+	tr := tar.NewReader(gz)
+
+	d.modulesMux.Lock()
+	defer d.modulesMux.Unlock()
+
+	insert := insertParam{}
+	manifestSeen := cfg.VerifyManifest == nil
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading bundle tarball")
+		}
+		name := strings.TrimPrefix(hdr.Name, "/")
+
+		switch {
+		case name == ".manifest":
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if cfg.VerifyManifest != nil {
+				if err := cfg.VerifyManifest(bs); err != nil {
+					return errors.Wrap(err, "verifying bundle manifest")
+				}
+				manifestSeen = true
+			}
+		case name == "signatures.json" || name == ".signatures.json":
+			if cfg.VerifySignatures != nil {
+				bs, err := io.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				if err := cfg.VerifySignatures(bs); err != nil {
+					return errors.Wrap(err, "verifying bundle signatures")
+				}
+			}
+		case strings.HasSuffix(name, ".rego"):
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err := insert.add(name, string(bs)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, "data.json"):
+			var v interface{}
+			if err := json.NewDecoder(tr).Decode(&v); err != nil {
+				return errors.Wrapf(err, "decoding %s", name)
+			}
+			p, err := parsePath(bundleDataPath(name))
+			if err != nil {
+				return err
+			}
+			if err := d.writeDataEntry(ctx, p, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !manifestSeen {
+		return errors.New("bundle is missing a .manifest required for verification")
+	}
+
+	bytesWritten := 0
+	updatedModules := copyModules(d.modules, "")
+	for name, mod := range insert {
+		updatedModules[name] = mod.parsed
+		bytesWritten += len(mod.text)
+	}
+	txn, err := d.storage.NewTransaction(ctx, storage.WriteParams)
+	if err != nil {
+		return err
+	}
 	c := ast.NewCompiler().WithPathConflictsCheck(storage.NonEmpty(ctx, d.storage, txn))
 	if c.Compile(updatedModules); c.Failed() {
 		d.storage.Abort(ctx, txn)
-		return 0, c.Errors
+		return c.Errors
 	}
-
 	for name, mod := range insert {
 		if err := d.storage.UpsertPolicy(ctx, txn, name, []byte(mod.text)); err != nil {
 			d.storage.Abort(ctx, txn)
-			return 0, err
+			return err
 		}
 	}
 	if err := d.storage.Commit(ctx, txn); err != nil {
-		return 0, err
+		return err
 	}
+	span.SetAttributes(
+		attribute.Int("opa.modules.loaded", len(insert)),
+		attribute.Int("opa.policy.bytes_written", bytesWritten),
+	)
 	d.compiler = c
 	d.modules = updatedModules
-	return len(remove), nil
+	d.invalidateQueryCache()
+	return nil
 }
 
 func parsePath(path string) ([]string, error) {
@@ -166,7 +440,11 @@ func parsePath(path string) ([]string, error) {
 	return p, nil
 }
 
-func (d *driver) PutData(ctx context.Context, path string, data interface{}) error {
+func (d *driver) PutData(ctx context.Context, path string, data interface{}) (err error) {
+	ctx, span := d.tracer().Start(ctx, "local.PutData", trace.WithAttributes(attribute.String("opa.data.path", path)))
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
 	d.modulesMux.RLock()
 	defer d.modulesMux.RUnlock()
 	p, err := parsePath(path)
@@ -179,8 +457,11 @@ func (d *driver) PutData(ctx context.Context, path string, data interface{}) err
 	}
 	if _, err := d.storage.Read(ctx, txn, p); err != nil {
 		if storage.IsNotFound(err) {
-			if err := storage.MakeDir(ctx, d.storage, txn, p[:len(p)-1]); err != nil {
-				return err
+			if len(p) > 0 {
+				if err := storage.MakeDir(ctx, d.storage, txn, p[:len(p)-1]); err != nil {
+					d.storage.Abort(ctx, txn)
+					return err
+				}
 			}
 		} else {
 			d.storage.Abort(ctx, txn)
@@ -198,12 +479,17 @@ func (d *driver) PutData(ctx context.Context, path string, data interface{}) err
 	if err := d.storage.Commit(ctx, txn); err != nil {
 		return err
 	}
+	d.invalidateQueryCache()
 	return nil
 }
 
 // DeleteData deletes data from OPA and returns true if data was found and deleted, false
 // if data was not found, and any errors
-func (d *driver) DeleteData(ctx context.Context, path string) (bool, error) {
+func (d *driver) DeleteData(ctx context.Context, path string) (found bool, err error) {
+	ctx, span := d.tracer().Start(ctx, "local.DeleteData", trace.WithAttributes(attribute.String("opa.data.path", path)))
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
 	d.modulesMux.RLock()
 	defer d.modulesMux.RUnlock()
 	p, err := parsePath(path)
@@ -224,34 +510,58 @@ func (d *driver) DeleteData(ctx context.Context, path string) (bool, error) {
 	if err := d.storage.Commit(ctx, txn); err != nil {
 		return false, err
 	}
+	d.invalidateQueryCache()
 	return true, nil
 }
 
+// prepare returns a rego.PreparedEvalQuery for path, reusing one from the
+// query cache when the compiler hasn't changed since it was prepared. Every
+// prepared query carries the driver's tracer provider, so topdown's own
+// evaluation spans nest under whatever span is active on the eval context.
+func (d *driver) prepare(ctx context.Context, path string) (rego.PreparedEvalQuery, error) {
+	if d.queryCache == nil {
+		return rego.New(rego.Compiler(d.compiler), rego.Store(d.storage), rego.Query(path), d.distributedTracingOpts()).PrepareForEval(ctx)
+	}
+	key := fmt.Sprintf("%s@%d", path, atomic.LoadUint64(&d.compilerRev))
+	if pq, ok := d.queryCache.Get(key); ok {
+		return *pq, nil
+	}
+	pq, err := rego.New(rego.Compiler(d.compiler), rego.Store(d.storage), rego.Query(path), d.distributedTracingOpts()).PrepareForEval(ctx)
+	if err != nil {
+		return pq, err
+	}
+	d.queryCache.Put(key, &pq)
+	return pq, nil
+}
+
 func (d *driver) eval(ctx context.Context, path string, input interface{}, cfg *drivers.QueryCfg) (rego.ResultSet, *string, error) {
 	d.modulesMux.RLock()
 	defer d.modulesMux.RUnlock()
-	args := []func(*rego.Rego){
-		rego.Compiler(d.compiler),
-		rego.Store(d.storage),
-		rego.Input(input),
-		rego.Query(path),
+
+	pq, err := d.prepare(ctx, path)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	evalArgs := []rego.EvalOption{rego.EvalInput(input)}
 	if d.traceEnabled || cfg.TracingEnabled {
 		buf := topdown.NewBufferTracer()
-		args = append(args, rego.Tracer(buf))
-		rego := rego.New(args...)
-		res, err := rego.Eval(ctx)
+		evalArgs = append(evalArgs, rego.EvalTracer(buf))
+		res, err := pq.Eval(ctx, evalArgs...)
 		b := &bytes.Buffer{}
 		topdown.PrettyTrace(b, *buf)
 		t := b.String()
 		return res, &t, err
 	}
-	rego := rego.New(args...)
-	res, err := rego.Eval(ctx)
+	res, err := pq.Eval(ctx, evalArgs...)
 	return res, nil, err
 }
 
-func (d *driver) Query(ctx context.Context, path string, input interface{}, opts ...drivers.QueryOpt) (*drivers.Response, error) {
+func (d *driver) Query(ctx context.Context, path string, input interface{}, opts ...drivers.QueryOpt) (resp *drivers.Response, err error) {
+	ctx, span := d.tracer().Start(ctx, "local.Query", trace.WithAttributes(attribute.String("opa.query", path)))
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
 	cfg := &drivers.QueryCfg{}
 	for _, opt := range opts {
 		opt(cfg)
@@ -261,19 +571,71 @@ func (d *driver) Query(ctx context.Context, path string, input interface{}, opts
 		return nil, err
 	}
 	// Add a variable binding to the path
-	rs, trace, err := d.eval(ctx, path, input, cfg)
+	rs, queryTrace, err := d.eval(ctx, path, input, cfg)
 	if err != nil {
 		return nil, err
 	}
 	i := string(inp)
 	return &drivers.Response{
-		Trace:   trace,
-		Results: rs,
+		Trace:   queryTrace,
+		Results: &rs,
 		Input:   &i,
+		Target:  d.target,
 	}, nil
 }
 
-func (d *driver) Dump(ctx context.Context) (string, error) {
+// Compile partially evaluates query, treating the given paths as unknown,
+// and returns the residual queries and support modules rather than a final
+// result. This mirrors OPA's /v1/compile endpoint.
+func (d *driver) Compile(ctx context.Context, query string, unknowns []string, input interface{}) (resp *drivers.CompileResponse, err error) {
+	ctx, span := d.tracer().Start(ctx, "local.Compile", trace.WithAttributes(attribute.String("opa.query", query)))
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
+	d.modulesMux.RLock()
+	defer d.modulesMux.RUnlock()
+
+	unknownRefs := make([]*ast.Term, len(unknowns))
+	for i, u := range unknowns {
+		term, err := ast.ParseTerm(u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing unknown %q", u)
+		}
+		unknownRefs[i] = term
+	}
+
+	r := rego.New(
+		rego.Compiler(d.compiler),
+		rego.Store(d.storage),
+		rego.Query(query),
+		rego.ParsedUnknowns(unknownRefs),
+		rego.Input(input),
+		d.distributedTracingOpts(),
+	)
+	pq, err := r.Partial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp = &drivers.CompileResponse{
+		Queries: pq.Queries,
+		Support: pq.Support,
+	}
+	if d.translator != nil {
+		t, err := d.translator.Translate(pq.Queries, pq.Support)
+		if err != nil {
+			return nil, errors.Wrap(err, "translating partial result")
+		}
+		resp.Translated = t
+	}
+	return resp, nil
+}
+
+func (d *driver) Dump(ctx context.Context) (out string, err error) {
+	ctx, span := d.tracer().Start(ctx, "local.Dump")
+	defer span.End()
+	defer func() { recordErr(span, err) }()
+
 	d.modulesMux.RLock()
 	defer d.modulesMux.RUnlock()
 	mods := make(map[string]string, len(d.modules))
@@ -0,0 +1,187 @@
+// Package multi provides a drivers.Driver that composes several
+// target-specific Drivers behind a single value, so that a caller hosting
+// heterogeneous policy targets (e.g. "rego" and "wasm") doesn't need to
+// juggle multiple drivers.Driver values itself.
+package multi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/luckoseabraham/opa-driver/pkg/drivers"
+
+	"github.com/pkg/errors"
+)
+
+// Driver routes Driver calls to one of several underlying Drivers by
+// target name. Module and data paths are namespaced by target: a path or
+// module name of the form "<target>/<rest>" is routed to the Driver
+// registered under "<target>" and handed "<rest>" with that prefix
+// stripped; a path with no target prefix is routed to the default target.
+// Query instead takes its target from an explicit drivers.WithTarget
+// QueryOpt, falling back to the default target when none is given.
+type Driver struct {
+	mu            sync.RWMutex
+	drivers       map[string]drivers.Driver
+	defaultTarget string
+}
+
+var _ drivers.Driver = &Driver{}
+
+// New returns a Driver that routes to the given target-keyed drivers.
+// defaultTarget selects which one handles paths/queries with no explicit
+// target, and must be a key in targets.
+func New(targets map[string]drivers.Driver, defaultTarget string) (*Driver, error) {
+	if _, ok := targets[defaultTarget]; !ok {
+		return nil, errors.Errorf("default target %q has no registered driver", defaultTarget)
+	}
+	m := make(map[string]drivers.Driver, len(targets))
+	for target, d := range targets {
+		m[target] = d
+	}
+	return &Driver{drivers: m, defaultTarget: defaultTarget}, nil
+}
+
+func (d *Driver) driverFor(target string) (drivers.Driver, error) {
+	if target == "" {
+		target = d.defaultTarget
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	sub, ok := d.drivers[target]
+	if !ok {
+		return nil, errors.Errorf("no driver registered for target %q", target)
+	}
+	return sub, nil
+}
+
+// splitTarget pulls a leading "<target>/" segment off name, if present.
+// Without one, target is empty and the caller falls back to the default.
+func splitTarget(name string) (target, rest string) {
+	trimmed := strings.TrimPrefix(name, "/")
+	leadingSlash := len(trimmed) != len(name)
+	i := strings.IndexByte(trimmed, '/')
+	if i < 0 {
+		return "", name
+	}
+	target, rest = trimmed[:i], trimmed[i+1:]
+	if leadingSlash {
+		rest = "/" + rest
+	}
+	return target, rest
+}
+
+func (d *Driver) Init(ctx context.Context) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for target, sub := range d.drivers {
+		if err := sub.Init(ctx); err != nil {
+			return errors.Wrapf(err, "initializing target %q", target)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) PutModule(ctx context.Context, name string, src string) error {
+	target, rest := splitTarget(name)
+	sub, err := d.driverFor(target)
+	if err != nil {
+		return err
+	}
+	return sub.PutModule(ctx, rest, src)
+}
+
+func (d *Driver) DeleteModule(ctx context.Context, name string) (bool, error) {
+	target, rest := splitTarget(name)
+	sub, err := d.driverFor(target)
+	if err != nil {
+		return false, err
+	}
+	return sub.DeleteModule(ctx, rest)
+}
+
+func (d *Driver) PutData(ctx context.Context, path string, data interface{}) error {
+	target, rest := splitTarget(path)
+	sub, err := d.driverFor(target)
+	if err != nil {
+		return err
+	}
+	return sub.PutData(ctx, rest, data)
+}
+
+func (d *Driver) DeleteData(ctx context.Context, path string) (bool, error) {
+	target, rest := splitTarget(path)
+	sub, err := d.driverFor(target)
+	if err != nil {
+		return false, err
+	}
+	return sub.DeleteData(ctx, rest)
+}
+
+// LoadBundle always loads into the default target: bundles have no
+// per-target namespacing convention of their own, unlike module names and
+// data paths.
+func (d *Driver) LoadBundle(ctx context.Context, r io.Reader, opts ...drivers.BundleOpt) error {
+	sub, err := d.driverFor(d.defaultTarget)
+	if err != nil {
+		return err
+	}
+	return sub.LoadBundle(ctx, r, opts...)
+}
+
+func (d *Driver) Query(ctx context.Context, path string, input interface{}, opts ...drivers.QueryOpt) (*drivers.Response, error) {
+	cfg := &drivers.QueryCfg{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	sub, err := d.driverFor(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sub.Query(ctx, path, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Target == "" {
+		if cfg.Target != "" {
+			resp.Target = cfg.Target
+		} else {
+			resp.Target = d.defaultTarget
+		}
+	}
+	return resp, nil
+}
+
+// Compile always partially evaluates against the default target: like
+// LoadBundle, Compile's signature has no slot for an explicit target.
+func (d *Driver) Compile(ctx context.Context, query string, unknowns []string, input interface{}) (*drivers.CompileResponse, error) {
+	sub, err := d.driverFor(d.defaultTarget)
+	if err != nil {
+		return nil, err
+	}
+	return sub.Compile(ctx, query, unknowns, input)
+}
+
+// Dump returns a JSON object keyed by target name, with each value being
+// that target's own Dump() output.
+func (d *Driver) Dump(ctx context.Context) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	out := make(map[string]json.RawMessage, len(d.drivers))
+	for target, sub := range d.drivers {
+		s, err := sub.Dump(ctx)
+		if err != nil {
+			return "", errors.Wrapf(err, "dumping target %q", target)
+		}
+		out[target] = json.RawMessage(s)
+	}
+	b, err := json.MarshalIndent(out, "", "   ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
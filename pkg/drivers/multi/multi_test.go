@@ -0,0 +1,191 @@
+package multi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/luckoseabraham/opa-driver/pkg/drivers"
+	"github.com/luckoseabraham/opa-driver/pkg/drivers/local"
+)
+
+func TestSplitTarget(t *testing.T) {
+	cases := []struct {
+		name       string
+		in         string
+		wantTarget string
+		wantRest   string
+	}{
+		{"no prefix", "mod.rego", "", "mod.rego"},
+		{"prefix", "a/mod.rego", "a", "mod.rego"},
+		{"nested rest", "a/dir/mod.rego", "a", "dir/mod.rego"},
+		{"leading slash, no prefix", "/mod.rego", "", "/mod.rego"},
+		{"leading slash, prefix", "/a/mod.rego", "a", "/mod.rego"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target, rest := splitTarget(c.in)
+			if target != c.wantTarget || rest != c.wantRest {
+				t.Fatalf("splitTarget(%q) = (%q, %q); want (%q, %q)", c.in, target, rest, c.wantTarget, c.wantRest)
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnknownDefaultTarget(t *testing.T) {
+	targets := map[string]drivers.Driver{"a": local.New()}
+	if _, err := New(targets, "b"); err == nil {
+		t.Fatal("New with a defaultTarget absent from targets: expected an error, got nil")
+	}
+}
+
+func newMulti(t *testing.T) *Driver {
+	t.Helper()
+	targets := map[string]drivers.Driver{
+		"a": local.New(),
+		"b": local.New(),
+	}
+	d, err := New(targets, "a")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return d
+}
+
+func TestPutModuleRoutesByTargetPrefix(t *testing.T) {
+	ctx := context.Background()
+	d := newMulti(t)
+
+	if err := d.PutModule(ctx, "mod.rego", "package a\n"); err != nil {
+		t.Fatalf("PutModule (default target): %v", err)
+	}
+	if err := d.PutModule(ctx, "b/mod.rego", "package b\n"); err != nil {
+		t.Fatalf("PutModule (explicit target): %v", err)
+	}
+
+	if ok, err := d.drivers["a"].DeleteModule(ctx, "mod.rego"); err != nil || !ok {
+		t.Fatalf("expected mod.rego to have landed on target %q: ok=%v err=%v", "a", ok, err)
+	}
+	if ok, err := d.drivers["b"].DeleteModule(ctx, "mod.rego"); err != nil || !ok {
+		t.Fatalf("expected b/mod.rego to have landed, with the prefix stripped, on target %q: ok=%v err=%v", "b", ok, err)
+	}
+}
+
+func TestPutModuleUnknownTarget(t *testing.T) {
+	d := newMulti(t)
+	err := d.PutModule(context.Background(), "c/mod.rego", "package c\n")
+	if err == nil {
+		t.Fatal("PutModule with an unregistered target prefix: expected an error, got nil")
+	}
+}
+
+func TestPutDataRoutesByTargetPrefix(t *testing.T) {
+	ctx := context.Background()
+	d := newMulti(t)
+
+	if err := d.PutData(ctx, "/x", 1); err != nil {
+		t.Fatalf("PutData (default target): %v", err)
+	}
+	if err := d.PutData(ctx, "/b/y", 2); err != nil {
+		t.Fatalf("PutData (explicit target): %v", err)
+	}
+
+	if ok, err := d.drivers["a"].DeleteData(ctx, "/x"); err != nil || !ok {
+		t.Fatalf("expected /x to have landed on target %q: ok=%v err=%v", "a", ok, err)
+	}
+	if ok, err := d.drivers["b"].DeleteData(ctx, "/y"); err != nil || !ok {
+		t.Fatalf("expected /b/y to have landed, with the prefix stripped, on target %q: ok=%v err=%v", "b", ok, err)
+	}
+}
+
+// stubDriver is a minimal drivers.Driver whose Query never fills in its own
+// Response.Target, standing in for a sub-driver that doesn't self-identify,
+// so tests can exercise Driver.Query's own fallback logic in isolation from
+// any particular sub-driver's opinion about its target name.
+type stubDriver struct {
+	drivers.Driver
+}
+
+func (stubDriver) Query(ctx context.Context, path string, input interface{}, opts ...drivers.QueryOpt) (*drivers.Response, error) {
+	return &drivers.Response{}, nil
+}
+
+func TestQueryTargetFallback(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(map[string]drivers.Driver{"a": stubDriver{}, "b": stubDriver{}}, "a")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	resp, err := d.Query(ctx, "data.allow", nil)
+	if err != nil {
+		t.Fatalf("Query (no target, falls back to default): %v", err)
+	}
+	if resp.Target != "a" {
+		t.Fatalf("Response.Target = %q; want the default target %q filled in", resp.Target, "a")
+	}
+
+	resp, err = d.Query(ctx, "data.allow", nil, drivers.WithTarget("b"))
+	if err != nil {
+		t.Fatalf("Query (explicit target): %v", err)
+	}
+	if resp.Target != "b" {
+		t.Fatalf("Response.Target = %q; want the explicit target %q filled in", resp.Target, "b")
+	}
+}
+
+// TestQueryLeavesSelfReportedTargetAlone checks Driver doesn't overwrite a
+// Response.Target a sub-driver already filled in itself, using the real
+// local driver, which always reports its own target name.
+func TestQueryLeavesSelfReportedTargetAlone(t *testing.T) {
+	ctx := context.Background()
+	d := newMulti(t)
+
+	if err := d.PutModule(ctx, "mod.rego", "package a\n\nallow { true }\n"); err != nil {
+		t.Fatalf("PutModule: %v", err)
+	}
+
+	resp, err := d.Query(ctx, "data.a.allow", nil)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if resp.Target != "rego" {
+		t.Fatalf("Response.Target = %q; expected the sub-driver's self-reported target %q to pass through, not the multi target name", resp.Target, "rego")
+	}
+}
+
+func TestQueryUnknownTarget(t *testing.T) {
+	d := newMulti(t)
+	_, err := d.Query(context.Background(), "data.a.allow", nil, drivers.WithTarget("c"))
+	if err == nil {
+		t.Fatal("Query with an unregistered target: expected an error, got nil")
+	}
+}
+
+func TestDumpAggregatesPerTarget(t *testing.T) {
+	ctx := context.Background()
+	d := newMulti(t)
+
+	if err := d.PutData(ctx, "/x", 1); err != nil {
+		t.Fatalf("PutData: %v", err)
+	}
+	if err := d.PutData(ctx, "/b/y", 2); err != nil {
+		t.Fatalf("PutData: %v", err)
+	}
+
+	out, err := d.Dump(ctx)
+	if err != nil {
+		t.Fatalf("Dump: %v", err)
+	}
+
+	var byTarget map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(out), &byTarget); err != nil {
+		t.Fatalf("Dump output isn't a JSON object keyed by target: %v", err)
+	}
+	if _, ok := byTarget["a"]; !ok {
+		t.Fatalf("Dump output missing target %q: %s", "a", out)
+	}
+	if _, ok := byTarget["b"]; !ok {
+		t.Fatalf("Dump output missing target %q: %s", "b", out)
+	}
+}
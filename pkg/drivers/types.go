@@ -1,6 +1,9 @@
 package drivers
 
-import "github.com/open-policy-agent/opa/rego"
+import (
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
 
 type Response struct {
 	Trace   *string
@@ -8,3 +11,23 @@ type Response struct {
 	Target  string
 	Results *rego.ResultSet
 }
+
+// CompileResponse is the result of a partial evaluation, matching the shape
+// of upstream OPA's /v1/compile API: the residual queries and any support
+// modules they depend on.
+type CompileResponse struct {
+	Queries []ast.Body    `json:"queries,omitempty"`
+	Support []*ast.Module `json:"support,omitempty"`
+	// Translated holds the output of passing Queries/Support through a
+	// PartialTranslator, if one was configured, e.g. a SQL WHERE clause
+	// or an Elasticsearch DSL filter equivalent to the residual policy.
+	Translated interface{} `json:"translated,omitempty"`
+}
+
+// PartialTranslator turns the residual of a partial evaluation into some
+// other representation a downstream data layer understands, so that
+// callers can push filtering down to SQL, Elasticsearch, etc. instead of
+// evaluating the residual themselves.
+type PartialTranslator interface {
+	Translate(queries []ast.Body, support []*ast.Module) (interface{}, error)
+}